@@ -19,32 +19,32 @@ package cmd
 import (
 	"fmt"
 	"io"
-	"reflect"
 	"strings"
 
 	"github.com/spf13/cobra"
 
 	"k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/api/meta"
-	"k8s.io/kubernetes/pkg/controller"
-	// "k8s.io/kubernetes/pkg/api/unversioned"
-	client "k8s.io/kubernetes/pkg/client/unversioned"
-	"k8s.io/kubernetes/pkg/fields"
 	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
+	"k8s.io/kubernetes/pkg/kubectl/drain"
 	"k8s.io/kubernetes/pkg/kubectl/resource"
-	"k8s.io/kubernetes/pkg/kubelet/types"
 	"k8s.io/kubernetes/pkg/runtime"
 )
 
+// DrainOptions holds the flags and Builder-resolved nodes for the cordon,
+// uncordon and drain commands. The actual cordon/drain algorithm lives in
+// drain.Helper; this type is a thin cobra/kubectl-Factory wrapper around it
+// that resolves a NODE argument or --selector into one or more nodes.
 type DrainOptions struct {
-	client             *client.Client
-	factory            *cmdutil.Factory
-	Force              bool
-	GracePeriodSeconds int
-	mapper             meta.RESTMapper
-	nodeInfo           *resource.Info
-	out                io.Writer
-	typer              runtime.ObjectTyper
+	drain.Helper
+
+	factory   *cmdutil.Factory
+	Selector  string
+	DryRun    bool
+	mapper    meta.RESTMapper
+	nodeInfos []*resource.Info
+	out       io.Writer
+	typer     runtime.ObjectTyper
 }
 
 const (
@@ -58,8 +58,8 @@ $ kubectl cordon foo
 func NewCmdCordon(f *cmdutil.Factory, out io.Writer) *cobra.Command {
 	options := &DrainOptions{factory: f, out: out}
 
-	return &cobra.Command{
-		Use:     "cordon NODE",
+	cmd := &cobra.Command{
+		Use:     "cordon (NODE | -l label)",
 		Short:   "Mark node as unschedulable",
 		Long:    cordon_long,
 		Example: cordon_example,
@@ -68,6 +68,8 @@ func NewCmdCordon(f *cmdutil.Factory, out io.Writer) *cobra.Command {
 			cmdutil.CheckErr(options.RunCordonOrUncordon(true))
 		},
 	}
+	cmd.Flags().StringVarP(&options.Selector, "selector", "l", "", "Selector (label query) to filter nodes on")
+	return cmd
 }
 
 const (
@@ -81,8 +83,8 @@ $ kubectl uncordon foo
 func NewCmdUncordon(f *cmdutil.Factory, out io.Writer) *cobra.Command {
 	options := &DrainOptions{factory: f, out: out}
 
-	return &cobra.Command{
-		Use:     "uncordon NODE",
+	cmd := &cobra.Command{
+		Use:     "uncordon (NODE | -l label)",
 		Short:   "Mark node as schedulable",
 		Long:    uncordon_long,
 		Example: uncordon_example,
@@ -91,16 +93,29 @@ func NewCmdUncordon(f *cmdutil.Factory, out io.Writer) *cobra.Command {
 			cmdutil.CheckErr(options.RunCordonOrUncordon(false))
 		},
 	}
+	cmd.Flags().StringVarP(&options.Selector, "selector", "l", "", "Selector (label query) to filter nodes on")
+	return cmd
 }
 
 const (
 	drain_long = `Drain node in preparation for maintenance.
 
 The given node will be marked unschedulable to prevent new pods from arriving.
-Then drain deletes all pods except mirror pods (which cannot be deleted through
-the API server).  If there are any pods that are neither mirror pods nor
-managed by a ReplicationController, Job, or DaemonSet, then drain will not
-delete any pods unless you use --force.
+Then drain evicts the pods if the API server supports eviction
+(https://kubernetes.io/docs/admin/disruptions/). Otherwise, it will use
+normal DELETE to delete the pods. The 'drain' evicts or deletes all pods
+except mirror pods (which cannot be deleted through the API server).  If
+there are any pods that are neither mirror pods nor managed by a
+ReplicationController, ReplicaSet, Job, DaemonSet or StatefulSet, then drain
+will not delete any pods unless you use --force. Using eviction respects
+PodDisruptionBudgets: if a pod's eviction would violate a PodDisruptionBudget, drain will retry
+until it succeeds or --timeout is reached. Pods backed by a DaemonSet are
+skipped entirely, rather than blocking the drain, if --ignore-daemonsets is
+given.
+
+Instead of naming a single node, --selector can be used to operate on every
+node matching a label query. --dry-run will print the pods that would be
+evicted from each matched node without evicting or deleting anything.
 
 When you are ready to put the node back into service, use kubectl uncordon, which
 will make the node schedulable again.
@@ -110,6 +125,9 @@ $ kubectl drain foo --force
 
 # As above, but abort if there are pods not managed by a ReplicationController, Job, or DaemonSet, and use a grace period of 15 minutes.
 $ kubectl drain foo --grace-period=900
+
+# Drain all nodes labeled upgrade=true, skipping DaemonSet-managed pods.
+$ kubectl drain -l upgrade=true --ignore-daemonsets
 `
 )
 
@@ -117,7 +135,7 @@ func NewCmdDrain(f *cmdutil.Factory, out io.Writer) *cobra.Command {
 	options := &DrainOptions{factory: f, out: out}
 
 	cmd := &cobra.Command{
-		Use:     "drain NODE",
+		Use:     "drain (NODE | -l label)",
 		Short:   "Drain node in preparation for maintenance",
 		Long:    drain_long,
 		Example: drain_example,
@@ -127,21 +145,39 @@ func NewCmdDrain(f *cmdutil.Factory, out io.Writer) *cobra.Command {
 		},
 	}
 	cmd.Flags().BoolVar(&options.Force, "force", false, "Continue even if there are pods not managed by a ReplicationController, Job, or DaemonSet.")
+	cmd.Flags().BoolVar(&options.IgnoreDaemonsets, "ignore-daemonsets", false, "Ignore DaemonSet-managed pods.")
 	cmd.Flags().IntVar(&options.GracePeriodSeconds, "grace-period", -1, "Period of time in seconds given to each pod to terminate gracefully. If negative, the default value specified in the pod will be used.")
+	cmd.Flags().DurationVar(&options.Timeout, "timeout", 0, "The length of time to wait before giving up on a pod terminating or being evicted, zero means infinite")
+	cmd.Flags().BoolVar(&options.DisableEviction, "disable-eviction", false, "Force drain to use delete, even if eviction is supported. This will bypass checking PodDisruptionBudgets, use with caution.")
+	cmd.Flags().IntVar(&options.Parallelism, "parallelism", 10, "Number of pods to evict or delete at a time.")
+	cmd.Flags().StringVarP(&options.Selector, "selector", "l", "", "Selector (label query) to filter nodes on")
+	cmd.Flags().BoolVar(&options.DryRun, "dry-run", false, "Print the pods that would be evicted, without evicting them.")
 	return cmd
 }
 
-// SetupDrain populates some fields from the factory, grabs command line
-// arguments and looks up the node using Builder
+// SetupDrain populates the embedded drain.Helper from the factory, grabs
+// command line arguments and looks up the node(s) using Builder. Exactly
+// one of a NODE argument or --selector must be given; with --selector,
+// o.nodeInfos may end up holding more than one node.
 func (o *DrainOptions) SetupDrain(cmd *cobra.Command, args []string) error {
 	var err error
-	if len(args) != 1 {
+	if len(args) == 0 && len(o.Selector) == 0 {
+		return cmdutil.UsageError(cmd, fmt.Sprintf("USAGE: %s [flags]", cmd.Use))
+	}
+	if len(args) > 0 && len(o.Selector) > 0 {
+		return cmdutil.UsageError(cmd, "cannot specify both a node name and --selector")
+	}
+	if len(args) > 1 {
 		return cmdutil.UsageError(cmd, fmt.Sprintf("USAGE: %s [flags]", cmd.Use))
 	}
 
-	if o.client, err = o.factory.Client(); err != nil {
+	if o.Client, err = o.factory.Client(); err != nil {
 		return err
 	}
+	o.Decoder = o.factory.Decoder(true)
+	if o.Out == nil {
+		o.Out = o.out
+	}
 
 	o.mapper, o.typer = o.factory.Object()
 
@@ -150,11 +186,14 @@ func (o *DrainOptions) SetupDrain(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	r := o.factory.NewBuilder().
-		NamespaceParam(cmdNamespace).DefaultNamespace().
-		ResourceNames("node", args[0]).
-		Do()
+	builder := o.factory.NewBuilder().NamespaceParam(cmdNamespace).DefaultNamespace()
+	if len(o.Selector) > 0 {
+		builder = builder.SelectorParam(o.Selector).ResourceTypes("node")
+	} else {
+		builder = builder.ResourceNames("node", args[0])
+	}
 
+	r := builder.Do()
 	if err = r.Err(); err != nil {
 		return err
 	}
@@ -163,145 +202,110 @@ func (o *DrainOptions) SetupDrain(cmd *cobra.Command, args []string) error {
 		if err != nil {
 			return err
 		}
-		o.nodeInfo = info
+		o.nodeInfos = append(o.nodeInfos, info)
 		return nil
 	})
 }
 
-// RunDrain runs the 'drain' command
+// RunDrain runs the 'drain' command against every node matched by
+// SetupDrain (either the single NODE argument or all nodes matching
+// --selector).
 func (o *DrainOptions) RunDrain() error {
-	if err := o.RunCordonOrUncordon(true); err != nil {
-		return err
+	if !o.DryRun {
+		if err := o.RunCordonOrUncordon(true); err != nil {
+			return err
+		}
 	}
 
-	pods, err := o.getPodsForDeletion()
-	if err != nil {
-		return err
+	failedNodeNames := []string{}
+	for _, nodeInfo := range o.nodeInfos {
+		if err := o.drainNode(nodeInfo); err != nil {
+			cmdutil.PrintError(o.mapper, false, o.out, nodeInfo.Mapping.Resource, nodeInfo.Name, err)
+			failedNodeNames = append(failedNodeNames, nodeInfo.Name)
+			continue
+		}
+		if !o.DryRun {
+			cmdutil.PrintSuccess(o.mapper, false, o.out, "node", nodeInfo.Name, "drained")
+		}
 	}
 
-	if err = o.deletePods(pods); err != nil {
-		return err
+	if len(failedNodeNames) > 0 {
+		return fmt.Errorf("failed to drain nodes: %s", strings.Join(failedNodeNames, ", "))
 	}
-	cmdutil.PrintSuccess(o.mapper, false, o.out, "node", o.nodeInfo.Name, "drained")
 	return nil
 }
 
-// getPodsForDeletion returns all the pods we're going to delete.  If there are
-// any unmanaged pods and the user didn't pass --force, we return that list in
-// an error.
-func (o *DrainOptions) getPodsForDeletion() ([]api.Pod, error) {
-	pods := []api.Pod{}
-	podList, err := o.client.Pods(api.NamespaceAll).List(api.ListOptions{FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": o.nodeInfo.Name})})
+// drainNode evicts or deletes the pods on a single node. With --dry-run, it
+// only lists the pods that would be evicted or deleted, without mutating
+// anything.
+func (o *DrainOptions) drainNode(nodeInfo *resource.Info) error {
+	pods, err := o.GetPodsForDeletion(nodeInfo.Name)
 	if err != nil {
-		return pods, err
+		return err
 	}
-	unreplicatedPodNames := []string{}
 
-	for _, pod := range podList.Items {
-		_, found := pod.ObjectMeta.Annotations[types.ConfigMirrorAnnotationKey]
-		if found {
-			// Skip mirror pod
-			continue
-		}
-		replicated := false
-
-		creatorRef, found := pod.ObjectMeta.Annotations[controller.CreatedByAnnotation]
-		if found {
-			// Now verify that the specified creator actually exists.
-			var sr api.SerializedReference
-			if err := runtime.DecodeInto(o.factory.Decoder(true), []byte(creatorRef), &sr); err != nil {
-				return pods, err
-			}
-			if sr.Reference.Kind == "ReplicationController" {
-				rc, err := o.client.ReplicationControllers(sr.Reference.Namespace).Get(sr.Reference.Name)
-				// Assume the only reason for an error is because the RC is
-				// gone/missing, not for any other cause.  TODO(mml): something more
-				// sophisticated than this
-				if err == nil && rc != nil {
-					replicated = true
-				}
-			} else if sr.Reference.Kind == "DaemonSet" {
-				ds, err := o.client.DaemonSets(sr.Reference.Namespace).Get(sr.Reference.Name)
-
-				// Assume the only reason for an error is because the DaemonSet is
-				// gone/missing, not for any other cause.  TODO(mml): something more
-				// sophisticated than this
-				if err == nil && ds != nil {
-					replicated = true
-				}
-			} else if sr.Reference.Kind == "Job" {
-				job, err := o.client.Jobs(sr.Reference.Namespace).Get(sr.Reference.Name)
-
-				// Assume the only reason for an error is because the Job is
-				// gone/missing, not for any other cause.  TODO(mml): something more
-				// sophisticated than this
-				if err == nil && job != nil {
-					replicated = true
-				}
+	if o.DryRun {
+		verb := "deleted"
+		if !o.DisableEviction {
+			if policyGroupVersion, err := o.SupportEviction(); err == nil && policyGroupVersion != "" {
+				verb = "evicted"
 			}
 		}
-		if replicated || o.Force {
-			pods = append(pods, pod)
-		}
-		if !replicated {
-			unreplicatedPodNames = append(unreplicatedPodNames, pod.Name)
+		for _, pod := range pods {
+			fmt.Fprintf(o.out, "pod %q on node %q would be %s\n", pod.Name, nodeInfo.Name, verb)
 		}
+		return nil
 	}
 
-	if len(unreplicatedPodNames) > 0 {
-		joined := strings.Join(unreplicatedPodNames, ", ")
-		if !o.Force {
-			return pods, fmt.Errorf("refusing to continue due to pods managed by neither a ReplicationController, nor a Job, nor a DaemonSet: %s (use --force to override)", joined)
-		}
-		fmt.Fprintf(o.out, "WARNING: About to delete these pods managed by neither a ReplicationController, nor a Job, nor a DaemonSet: %s\n", joined)
-	}
-	return pods, nil
+	return o.DeletePods(pods)
 }
 
-// deletePods deletes the pods on the api server
-func (o *DrainOptions) deletePods(pods []api.Pod) error {
-	deleteOptions := api.DeleteOptions{}
-	if o.GracePeriodSeconds >= 0 {
-		gracePeriodSeconds := int64(o.GracePeriodSeconds)
-		deleteOptions.GracePeriodSeconds = &gracePeriodSeconds
-	}
-
-	for _, pod := range pods {
-		err := o.client.Pods(pod.Namespace).Delete(pod.Name, &deleteOptions)
-		if err != nil {
-			return err
+// RunCordonOrUncordon runs either Cordon or Uncordon against every node
+// matched by SetupDrain.  The desired value for "Unschedulable" is passed as
+// the first arg.
+func (o *DrainOptions) RunCordonOrUncordon(desired bool) error {
+	failedNodeNames := []string{}
+	for _, nodeInfo := range o.nodeInfos {
+		if err := o.cordonOrUncordonNode(nodeInfo, desired); err != nil {
+			cmdutil.PrintError(o.mapper, false, o.out, nodeInfo.Mapping.Resource, nodeInfo.Name, err)
+			failedNodeNames = append(failedNodeNames, nodeInfo.Name)
 		}
-		cmdutil.PrintSuccess(o.mapper, false, o.out, "pod", pod.Name, "deleted")
 	}
 
+	if len(failedNodeNames) > 0 {
+		return fmt.Errorf("failed to %s nodes: %s", cordonVerb(desired), strings.Join(failedNodeNames, ", "))
+	}
 	return nil
 }
 
-// RunCordonOrUncordon runs either Cordon or Uncordon.  The desired value for
-// "Unschedulable" is passed as the first arg.
-func (o *DrainOptions) RunCordonOrUncordon(desired bool) error {
-	cmdNamespace, _, err := o.factory.DefaultNamespace()
-	if err != nil {
-		return err
+// cordonOrUncordonNode cordons or uncordons a single node.
+func (o *DrainOptions) cordonOrUncordonNode(nodeInfo *resource.Info, desired bool) error {
+	node, ok := nodeInfo.Object.(*api.Node)
+	if !ok {
+		// SetupDrain restricted the Builder to ResourceNames("node", ...) or
+		// SelectorParam(...).ResourceTypes("node"), so a failed assertion
+		// here means the Builder handed back something other than an
+		// internal *api.Node (e.g. a decode/version mismatch), not a
+		// legitimate non-node result. Treat it as an error rather than a
+		// silent no-op "skipped" success.
+		return fmt.Errorf("unexpected type %T for %q, expected *api.Node", nodeInfo.Object, nodeInfo.Name)
 	}
 
-	if o.nodeInfo.Mapping.GroupVersionKind.Kind == "Node" {
-		unsched := reflect.ValueOf(o.nodeInfo.Object).Elem().FieldByName("Spec").FieldByName("Unschedulable")
-		if unsched.Bool() == desired {
-			cmdutil.PrintSuccess(o.mapper, false, o.out, o.nodeInfo.Mapping.Resource, o.nodeInfo.Name, already(desired))
-		} else {
-			helper := resource.NewHelper(o.client, o.nodeInfo.Mapping)
-			unsched.SetBool(desired)
-			_, err := helper.Replace(cmdNamespace, o.nodeInfo.Name, true, o.nodeInfo.Object)
-			if err != nil {
-				return err
-			}
-			cmdutil.PrintSuccess(o.mapper, false, o.out, o.nodeInfo.Mapping.Resource, o.nodeInfo.Name, changed(desired))
-		}
-	} else {
-		cmdutil.PrintSuccess(o.mapper, false, o.out, o.nodeInfo.Mapping.Resource, o.nodeInfo.Name, "skipped")
+	if node.Spec.Unschedulable == desired {
+		cmdutil.PrintSuccess(o.mapper, false, o.out, nodeInfo.Mapping.Resource, nodeInfo.Name, already(desired))
+		return nil
 	}
 
+	var err error
+	if desired {
+		err = o.Cordon(node)
+	} else {
+		err = o.Uncordon(node)
+	}
+	if err != nil {
+		return err
+	}
+	cmdutil.PrintSuccess(o.mapper, false, o.out, nodeInfo.Mapping.Resource, nodeInfo.Name, changed(desired))
 	return nil
 }
 
@@ -320,3 +324,10 @@ func changed(desired bool) string {
 	}
 	return "uncordoned"
 }
+
+func cordonVerb(desired bool) string {
+	if desired {
+		return "cordon"
+	}
+	return "uncordon"
+}
@@ -0,0 +1,544 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package drain implements the algorithm behind the 'kubectl drain' and
+// 'kubectl cordon'/'uncordon' commands, factored out of pkg/kubectl/cmd so
+// that it can be driven directly against a clientset. This lets controllers
+// and operators (e.g. a node upgrade or reboot controller) cordon and drain
+// nodes in-process, without shelling out to kubectl, and lets the algorithm
+// be unit tested against a fake clientset.
+package drain
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/apis/policy"
+	client "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/controller"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/kubelet/types"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// EvictionKind and EvictionSubresource name the policy/v1beta1 Eviction
+// subresource used to evict a pod from a node with PodDisruptionBudget
+// enforcement, as opposed to a raw pod DELETE.
+const (
+	EvictionKind        = "Eviction"
+	EvictionSubresource = "pods/eviction"
+)
+
+// Helper contains the parameters and algorithm used to cordon, uncordon and
+// drain a node. Unlike the kubectl DrainOptions that wraps it, it is driven by a
+// typed clientset rather than a *cobra.Command and a kubectl Factory, so it
+// can be embedded directly by controllers and operators.
+type Helper struct {
+	// Client is the clientset the algorithm is driven against. It is typed
+	// as the client.Interface rather than the concrete *client.Client so
+	// that callers (and this package's own tests) can substitute
+	// testclient.NewSimpleFake(...) instead of a real apiserver connection.
+	Client client.Interface
+
+	// Force continues even if there are pods not managed by a
+	// ReplicationController, ReplicaSet, Job, DaemonSet or StatefulSet.
+	Force bool
+	// IgnoreDaemonsets causes DaemonSet-managed pods to be skipped rather
+	// than evicted or treated as unmanaged.
+	IgnoreDaemonsets bool
+	// GracePeriodSeconds is the grace period passed to the eviction/delete
+	// call. A negative value means use the pod's own grace period.
+	GracePeriodSeconds int
+	// Timeout bounds how long to retry a PDB-blocked eviction and how long
+	// to wait for a pod to actually terminate. Zero means no bound.
+	Timeout time.Duration
+	// DisableEviction forces use of DELETE even if the server supports the
+	// eviction subresource.
+	DisableEviction bool
+	// Parallelism is the number of pods to evict/delete concurrently.
+	Parallelism int
+
+	// Out receives progress and warning output. Defaults to ioutil.Discard
+	// if nil.
+	Out io.Writer
+	// Decoder decodes the CreatedByAnnotation found on a pod.
+	// Defaults to runtime.DecodeInto(api.Codecs.UniversalDecoder(), ...) if
+	// nil; callers that already have a decoder on hand (e.g. kubectl's
+	// Factory) can supply one to avoid constructing another.
+	Decoder runtime.Decoder
+
+	once               sync.Once
+	policyGroupVersion string
+	supportErr         error
+}
+
+func (d *Helper) out() io.Writer {
+	if d.Out != nil {
+		return d.Out
+	}
+	return ioutil.Discard
+}
+
+func (d *Helper) decoder() runtime.Decoder {
+	if d.Decoder != nil {
+		return d.Decoder
+	}
+	return api.Codecs.UniversalDecoder()
+}
+
+// Cordon marks node unschedulable.
+func (d *Helper) Cordon(node *api.Node) error {
+	return d.cordonOrUncordon(node, true)
+}
+
+// Uncordon marks node schedulable.
+func (d *Helper) Uncordon(node *api.Node) error {
+	return d.cordonOrUncordon(node, false)
+}
+
+func (d *Helper) cordonOrUncordon(node *api.Node, desired bool) error {
+	if node.Spec.Unschedulable == desired {
+		return nil
+	}
+	node.Spec.Unschedulable = desired
+	_, err := d.Client.Nodes().Update(node)
+	return err
+}
+
+// GetPodsForDeletion returns all the pods on nodeName that a drain should
+// evict or delete. If there are any pods not managed by a
+// ReplicationController, ReplicaSet, Job, DaemonSet or StatefulSet and Force
+// is false, it returns the managed pods together with an error listing the
+// unmanaged ones.
+func (d *Helper) GetPodsForDeletion(nodeName string) ([]api.Pod, error) {
+	pods := []api.Pod{}
+	podList, err := d.Client.Pods(api.NamespaceAll).List(api.ListOptions{FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": nodeName})})
+	if err != nil {
+		return pods, err
+	}
+	unreplicatedPodNames := []string{}
+
+	for _, pod := range podList.Items {
+		_, found := pod.ObjectMeta.Annotations[types.ConfigMirrorAnnotationKey]
+		if found {
+			// Skip mirror pod
+			continue
+		}
+		replicated := false
+		// controllerDescription names the pod's owner, e.g. "ReplicaSet foo"
+		// or, once resolved up one level, "Deployment foo". It is printed only
+		// for pods that count as unmanaged (their owner lookup failed), in the
+		// "refusing to continue"/"about to delete" messages below.
+		controllerDescription := ""
+
+		creatorRef, found := pod.ObjectMeta.Annotations[controller.CreatedByAnnotation]
+		if found {
+			// Now verify that the specified creator actually exists.
+			var sr api.SerializedReference
+			if err := runtime.DecodeInto(d.decoder(), []byte(creatorRef), &sr); err != nil {
+				return pods, err
+			}
+			if sr.Reference.Kind == "DaemonSet" && d.IgnoreDaemonsets {
+				// Skip DaemonSet-managed pods entirely: they are neither
+				// evicted nor counted against the unmanaged-pod list.
+				continue
+			}
+			controllerDescription = fmt.Sprintf("%s %s", sr.Reference.Kind, sr.Reference.Name)
+			switch sr.Reference.Kind {
+			case "ReplicationController":
+				rc, err := d.Client.ReplicationControllers(sr.Reference.Namespace).Get(sr.Reference.Name)
+				// Assume the only reason for an error is because the RC is
+				// gone/missing, not for any other cause.  TODO(mml): something more
+				// sophisticated than this
+				if err == nil && rc != nil {
+					replicated = true
+				}
+			case "DaemonSet":
+				ds, err := d.Client.DaemonSets(sr.Reference.Namespace).Get(sr.Reference.Name)
+
+				// Assume the only reason for an error is because the DaemonSet is
+				// gone/missing, not for any other cause.  TODO(mml): something more
+				// sophisticated than this
+				if err == nil && ds != nil {
+					replicated = true
+				}
+			case "Job":
+				job, err := d.Client.Jobs(sr.Reference.Namespace).Get(sr.Reference.Name)
+
+				// Assume the only reason for an error is because the Job is
+				// gone/missing, not for any other cause.  TODO(mml): something more
+				// sophisticated than this
+				if err == nil && job != nil {
+					replicated = true
+				}
+			case "ReplicaSet":
+				rs, err := d.Client.ReplicaSets(sr.Reference.Namespace).Get(sr.Reference.Name)
+				// Assume the only reason for an error is because the
+				// ReplicaSet is gone/missing, not for any other cause.
+				if err == nil && rs != nil {
+					replicated = true
+					// A Deployment's pods are owned by its ReplicaSet, not
+					// the Deployment itself; walk up one level to name the
+					// controller the user created. The pod is managed at
+					// this point, so this description is not printed in
+					// either message below.
+					if deploymentName, ok := deploymentOwning(d.decoder(), rs); ok {
+						controllerDescription = fmt.Sprintf("Deployment %s", deploymentName)
+					}
+				}
+			case "StatefulSet":
+				sts, err := d.Client.StatefulSets(sr.Reference.Namespace).Get(sr.Reference.Name)
+				// Assume the only reason for an error is because the
+				// StatefulSet is gone/missing, not for any other cause.
+				if err == nil && sts != nil {
+					replicated = true
+				}
+			}
+		}
+		if replicated || d.Force {
+			pods = append(pods, pod)
+		}
+		if !replicated {
+			name := pod.Name
+			if controllerDescription != "" {
+				name = fmt.Sprintf("%s (%s)", pod.Name, controllerDescription)
+			}
+			unreplicatedPodNames = append(unreplicatedPodNames, name)
+		}
+	}
+
+	if len(unreplicatedPodNames) > 0 {
+		joined := strings.Join(unreplicatedPodNames, ", ")
+		if !d.Force {
+			return pods, fmt.Errorf("refusing to continue due to pods managed by neither a ReplicationController, ReplicaSet, Job, DaemonSet, nor StatefulSet: %s (use --force to override)", joined)
+		}
+		fmt.Fprintf(d.out(), "WARNING: About to delete these pods managed by neither a ReplicationController, ReplicaSet, Job, DaemonSet, nor StatefulSet: %s\n", joined)
+	}
+	return pods, nil
+}
+
+// deploymentOwning returns the name of the Deployment that created rs, if
+// rs's own CreatedByAnnotation names one. GetPodsForDeletion calls it only
+// for pods whose ReplicaSet exists; such pods are managed, so the Deployment
+// name it returns does not appear in GetPodsForDeletion's error or warning.
+func deploymentOwning(decoder runtime.Decoder, rs *extensions.ReplicaSet) (string, bool) {
+	creatorRef, found := rs.ObjectMeta.Annotations[controller.CreatedByAnnotation]
+	if !found {
+		return "", false
+	}
+	var sr api.SerializedReference
+	if err := runtime.DecodeInto(decoder, []byte(creatorRef), &sr); err != nil {
+		return "", false
+	}
+	if sr.Reference.Kind != "Deployment" {
+		return "", false
+	}
+	return sr.Reference.Name, true
+}
+
+// SupportEviction uses Discovery to check if the server supports the
+// eviction subresource. If it does, it returns the group version to post
+// Eviction objects against; an empty string means eviction is unsupported
+// and the caller should fall back to a plain DELETE. The result is cached
+// on the Helper, since it only needs to be checked once per drain.
+func (d *Helper) SupportEviction() (string, error) {
+	d.once.Do(func() {
+		d.policyGroupVersion, d.supportErr = d.checkEvictionSupport()
+	})
+	return d.policyGroupVersion, d.supportErr
+}
+
+func (d *Helper) checkEvictionSupport() (string, error) {
+	discoveryClient := d.Client.Discovery()
+	groupList, err := discoveryClient.ServerGroups()
+	if err != nil {
+		return "", err
+	}
+	foundPolicyGroup := false
+	var policyGroupVersion string
+	for _, group := range groupList.Groups {
+		if group.Name == "policy" {
+			foundPolicyGroup = true
+			policyGroupVersion = group.PreferredVersion.GroupVersion
+			break
+		}
+	}
+	if !foundPolicyGroup {
+		return "", nil
+	}
+	resourceList, err := discoveryClient.ServerResourcesForGroupVersion("v1")
+	if err != nil {
+		return "", err
+	}
+	for _, resource := range resourceList.APIResources {
+		if resource.Name == EvictionSubresource && resource.Kind == EvictionKind {
+			return policyGroupVersion, nil
+		}
+	}
+	return "", nil
+}
+
+// EvictOrDeletePod evicts pod through the policy/v1beta1 Eviction
+// subresource if the server supports it and DisableEviction is false,
+// retrying with exponential backoff while a PodDisruptionBudget blocks the
+// eviction (bounded by Timeout), falling back to a plain DELETE otherwise.
+func (d *Helper) EvictOrDeletePod(pod api.Pod) error {
+	policyGroupVersion := ""
+	if !d.DisableEviction {
+		var err error
+		if policyGroupVersion, err = d.SupportEviction(); err != nil {
+			return err
+		}
+	}
+
+	deleteOptions := &api.DeleteOptions{}
+	if d.GracePeriodSeconds >= 0 {
+		gracePeriodSeconds := int64(d.GracePeriodSeconds)
+		deleteOptions.GracePeriodSeconds = &gracePeriodSeconds
+	}
+
+	if policyGroupVersion == "" {
+		return d.Client.Pods(pod.Namespace).Delete(pod.Name, deleteOptions)
+	}
+
+	eviction := &policy.Eviction{
+		TypeMeta: unversioned.TypeMeta{
+			APIVersion: policyGroupVersion,
+			Kind:       EvictionKind,
+		},
+		ObjectMeta: api.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+		DeleteOptions: deleteOptions,
+	}
+
+	return d.evictWithBackoff(eviction)
+}
+
+// evictWithBackoff posts eviction attempts with exponential backoff while
+// the API server reports 429 (a PodDisruptionBudget currently blocks the
+// eviction). Retries are bounded by Timeout; a Timeout of zero retries
+// indefinitely, matching the --timeout flag's documented "zero means
+// infinite".
+func (d *Helper) evictWithBackoff(eviction *policy.Eviction) error {
+	var deadline time.Time
+	hasDeadline := d.Timeout > 0
+	if hasDeadline {
+		deadline = time.Now().Add(d.Timeout)
+	}
+
+	delay := 100 * time.Millisecond
+	const maxDelay = 5 * time.Second
+	for {
+		err := d.Client.Policy().Evictions(eviction.Namespace).Evict(eviction)
+		if err == nil {
+			return nil
+		}
+		if !apierrors.IsTooManyRequests(err) {
+			return err
+		}
+		if hasDeadline && time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("timed out waiting for eviction of pod %q to succeed: %v", eviction.Name, err)
+		}
+		fmt.Fprintf(d.out(), "WARNING: eviction of pod %q blocked by PodDisruptionBudget, retrying\n", eviction.Name)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// podDeleteResult carries the outcome of evicting/deleting a single pod and
+// then waiting for it to actually terminate.
+type podDeleteResult struct {
+	pod api.Pod
+	err error
+}
+
+// DeletePods evicts or deletes pods using a worker pool of Parallelism
+// goroutines and blocks until every pod has actually terminated on the node
+// or Timeout has elapsed, streaming a status line to Out as each pod
+// terminates. It returns an aggregated error naming the pods that failed to
+// evict/delete or terminate in time.
+func (d *Helper) DeletePods(pods []api.Pod) error {
+	if len(pods) == 0 {
+		return nil
+	}
+
+	parallelism := d.Parallelism
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	if parallelism > len(pods) {
+		parallelism = len(pods)
+	}
+
+	podCh := make(chan api.Pod, len(pods))
+	resultCh := make(chan podDeleteResult, len(pods))
+
+	var wg sync.WaitGroup
+	wg.Add(parallelism)
+	for i := 0; i < parallelism; i++ {
+		go func() {
+			defer wg.Done()
+			for pod := range podCh {
+				err := d.EvictOrDeletePod(pod)
+				if err == nil {
+					err = d.waitForDelete(pod)
+				}
+				resultCh <- podDeleteResult{pod: pod, err: err}
+			}
+		}()
+	}
+	for _, pod := range pods {
+		podCh <- pod
+	}
+	close(podCh)
+
+	// Close resultCh once every worker has finished, but in the background:
+	// the range below must keep draining resultCh concurrently so each
+	// status line prints as that pod terminates, not after the slowest pod
+	// in the batch.
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	failedPodNames := []string{}
+	for result := range resultCh {
+		if result.err != nil {
+			fmt.Fprintf(d.out(), "error: unable to drain pod %q: %v\n", result.pod.Name, result.err)
+			failedPodNames = append(failedPodNames, result.pod.Name)
+			continue
+		}
+		fmt.Fprintf(d.out(), "pod %q deleted\n", result.pod.Name)
+	}
+
+	if len(failedPodNames) > 0 {
+		return fmt.Errorf("failed to evict/delete and terminate pods: %s", strings.Join(failedPodNames, ", "))
+	}
+	return nil
+}
+
+// waitForDelete watches pod until the apiserver reports it gone, bounded by
+// Timeout; a Timeout of zero waits indefinitely. The apiserver is free to
+// close a watch at any time (e.g. minRequestTimeout, or a transient network
+// drop) long before the pod actually terminates, so a closed watch is not
+// itself treated as confirmation of deletion: waitForDelete re-checks the
+// pod directly and, if it still exists, re-establishes the watch from where
+// it left off, backing off between reconnect attempts so a server that keeps
+// closing the watch immediately (e.g. on a too-old resourceVersion) can't
+// turn this into a hot Watch+Get spin.
+func (d *Helper) waitForDelete(pod api.Pod) error {
+	var deadline time.Time
+	hasDeadline := d.Timeout > 0
+	if hasDeadline {
+		deadline = time.Now().Add(d.Timeout)
+	}
+
+	resourceVersion := pod.ResourceVersion
+	delay := 100 * time.Millisecond
+	const maxDelay = 5 * time.Second
+	for {
+		var timeoutCh <-chan time.Time
+		var timer *time.Timer
+		if hasDeadline {
+			remaining := deadline.Sub(time.Now())
+			if remaining <= 0 {
+				return fmt.Errorf("timed out waiting for pod %q to terminate", pod.Name)
+			}
+			timer = time.NewTimer(remaining)
+			timeoutCh = timer.C
+		}
+
+		w, err := d.Client.Pods(pod.Namespace).Watch(api.ListOptions{
+			FieldSelector:   fields.SelectorFromSet(fields.Set{"metadata.name": pod.Name}),
+			ResourceVersion: resourceVersion,
+		})
+		if err != nil {
+			if timer != nil {
+				timer.Stop()
+			}
+			return err
+		}
+
+		gone, closed, err := d.watchUntilDeletedOrClosed(w, &resourceVersion, timeoutCh)
+		w.Stop()
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+		if gone {
+			return nil
+		}
+		if !closed {
+			return fmt.Errorf("timed out waiting for pod %q to terminate", pod.Name)
+		}
+
+		// The watch closed without delivering a Deleted event; confirm
+		// directly before looping around to re-establish it.
+		if _, err := d.Client.Pods(pod.Namespace).Get(pod.Name); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+
+		if hasDeadline && time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("timed out waiting for pod %q to terminate", pod.Name)
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// watchUntilDeletedOrClosed drains w until it sees the pod deleted, the
+// watch closes on its own, or timeoutCh fires. On non-Deleted pod events it
+// advances *resourceVersion so the caller can resume the watch from there.
+func (d *Helper) watchUntilDeletedOrClosed(w watch.Interface, resourceVersion *string, timeoutCh <-chan time.Time) (gone bool, closed bool, err error) {
+	for {
+		select {
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return false, true, nil
+			}
+			if event.Type == watch.Deleted {
+				return true, false, nil
+			}
+			if updated, ok := event.Object.(*api.Pod); ok {
+				*resourceVersion = updated.ResourceVersion
+			}
+		case <-timeoutCh:
+			return false, false, nil
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package drain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/apis/policy"
+	"k8s.io/kubernetes/pkg/client/unversioned/testclient"
+	"k8s.io/kubernetes/pkg/controller"
+	"k8s.io/kubernetes/pkg/kubelet/types"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// createdByRef returns a CreatedByAnnotation value naming a controller of
+// the given kind, namespace and name, as api.SerializedReference would
+// serialize it.
+func createdByRef(kind, namespace, name string) string {
+	return fmt.Sprintf(`{"reference":{"kind":"%s","namespace":"%s","name":"%s"}}`, kind, namespace, name)
+}
+
+func newPod(name, createdBy string) api.Pod {
+	pod := api.Pod{
+		ObjectMeta: api.ObjectMeta{
+			Name:      name,
+			Namespace: api.NamespaceDefault,
+		},
+	}
+	if createdBy != "" {
+		pod.Annotations = map[string]string{controller.CreatedByAnnotation: createdBy}
+	}
+	return pod
+}
+
+func TestGetPodsForDeletion(t *testing.T) {
+	rc := &api.ReplicationController{ObjectMeta: api.ObjectMeta{Name: "rc", Namespace: api.NamespaceDefault}}
+	rs := &extensions.ReplicaSet{ObjectMeta: api.ObjectMeta{Name: "rs", Namespace: api.NamespaceDefault}}
+
+	replicatedPod := newPod("replicated", createdByRef("ReplicationController", api.NamespaceDefault, "rc"))
+	replicaSetPod := newPod("rs-owned", createdByRef("ReplicaSet", api.NamespaceDefault, "rs"))
+	daemonsetPod := newPod("ds-owned", createdByRef("DaemonSet", api.NamespaceDefault, "ds"))
+	unmanagedPod := newPod("unmanaged", "")
+	mirrorPod := newPod("mirror", "")
+	mirrorPod.Annotations = map[string]string{types.ConfigMirrorAnnotationKey: ""}
+
+	client := testclient.NewSimpleFake(rc, rs,
+		&replicatedPod, &replicaSetPod, &daemonsetPod, &unmanagedPod, &mirrorPod)
+
+	d := &Helper{Client: client, IgnoreDaemonsets: true}
+	pods, err := d.GetPodsForDeletion("node1")
+	if err == nil {
+		t.Fatalf("expected an error listing the unmanaged pod, got pods=%v", pods)
+	}
+
+	names := map[string]bool{}
+	for _, p := range pods {
+		names[p.Name] = true
+	}
+	if !names["replicated"] || !names["rs-owned"] {
+		t.Errorf("expected replicated and rs-owned pods to be selected for deletion, got %v", names)
+	}
+	if names["ds-owned"] {
+		t.Errorf("expected DaemonSet-managed pod to be skipped with IgnoreDaemonsets set, got %v", names)
+	}
+	if names["mirror"] {
+		t.Errorf("expected mirror pod to never be selected for deletion, got %v", names)
+	}
+	if names["unmanaged"] {
+		t.Errorf("expected unmanaged pod to be reported as an error, not silently returned, got %v", names)
+	}
+}
+
+func TestGetPodsForDeletionForce(t *testing.T) {
+	unmanagedPod := newPod("unmanaged", "")
+	client := testclient.NewSimpleFake(&unmanagedPod)
+
+	d := &Helper{Client: client, Force: true}
+	pods, err := d.GetPodsForDeletion("node1")
+	if err != nil {
+		t.Fatalf("expected Force to allow unmanaged pods, got error: %v", err)
+	}
+	if len(pods) != 1 || pods[0].Name != "unmanaged" {
+		t.Errorf("expected the unmanaged pod to be returned, got %v", pods)
+	}
+}
+
+func TestDeploymentOwning(t *testing.T) {
+	decoder := api.Codecs.UniversalDecoder()
+
+	rs := &extensions.ReplicaSet{
+		ObjectMeta: api.ObjectMeta{
+			Name:      "myapp-12345",
+			Namespace: api.NamespaceDefault,
+			Annotations: map[string]string{
+				controller.CreatedByAnnotation: createdByRef("Deployment", api.NamespaceDefault, "myapp"),
+			},
+		},
+	}
+	name, ok := deploymentOwning(decoder, rs)
+	if !ok || name != "myapp" {
+		t.Errorf("expected deploymentOwning to resolve Deployment %q, got (%q, %v)", "myapp", name, ok)
+	}
+
+	rsWithoutOwner := &extensions.ReplicaSet{ObjectMeta: api.ObjectMeta{Name: "standalone", Namespace: api.NamespaceDefault}}
+	if _, ok := deploymentOwning(decoder, rsWithoutOwner); ok {
+		t.Errorf("expected deploymentOwning to report no owner for a ReplicaSet with no CreatedByAnnotation")
+	}
+}
+
+func TestEvictWithBackoffRetriesThenSucceeds(t *testing.T) {
+	fake := testclient.NewSimpleFake()
+	attempts := 0
+	fake.AddReactor("create", "pods", func(action testclient.Action) (bool, runtime.Object, error) {
+		attempts++
+		if attempts < 3 {
+			return true, nil, apierrors.NewTooManyRequests("blocked by PodDisruptionBudget", 1)
+		}
+		return true, nil, nil
+	})
+
+	d := &Helper{Client: fake}
+	eviction := &policy.Eviction{ObjectMeta: api.ObjectMeta{Name: "pod1", Namespace: api.NamespaceDefault}}
+	if err := d.evictWithBackoff(eviction); err != nil {
+		t.Fatalf("expected evictWithBackoff to succeed once the PDB stops blocking, got: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestEvictWithBackoffTimesOut(t *testing.T) {
+	fake := testclient.NewSimpleFake()
+	fake.AddReactor("create", "pods", func(action testclient.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewTooManyRequests("blocked by PodDisruptionBudget", 1)
+	})
+
+	d := &Helper{Client: fake, Timeout: 200 * time.Millisecond}
+	eviction := &policy.Eviction{ObjectMeta: api.ObjectMeta{Name: "pod1", Namespace: api.NamespaceDefault}}
+	if err := d.evictWithBackoff(eviction); err == nil {
+		t.Fatalf("expected evictWithBackoff to time out against a permanently blocked eviction")
+	}
+}
+
+// TestWaitForDeleteReconnectsOnClosedWatch exercises the case the review
+// flagged: the apiserver can close a watch (e.g. minRequestTimeout) well
+// before the pod actually terminates. waitForDelete must not treat that as
+// deletion; it should re-check the pod directly and only return once it
+// observes the pod gone.
+func TestWaitForDeleteReconnectsOnClosedWatch(t *testing.T) {
+	pod := newPod("pod1", "")
+
+	fake := testclient.NewSimpleFake()
+	fake.AddWatchReactor("pods", func(action testclient.Action) (bool, watch.Interface, error) {
+		w := watch.NewFake()
+		// Simulate the apiserver closing the watch with no Deleted event.
+		w.Stop()
+		return true, w, nil
+	})
+	fake.AddReactor("get", "pods", func(action testclient.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(api.Resource("pods"), pod.Name)
+	})
+
+	d := &Helper{Client: fake}
+	if err := d.waitForDelete(pod); err != nil {
+		t.Fatalf("expected waitForDelete to confirm deletion via Get after a closed watch, got: %v", err)
+	}
+}